@@ -0,0 +1,28 @@
+package leakybucket
+
+// evictedKey records a key removed by gc, along with the token count it
+// held and whether it was idle (see shard.idle) at the moment of removal,
+// so the caller can classify it as a forced eviction or a natural drain
+// once the shard's lock is released.
+type evictedKey struct {
+	key    uint64
+	tokens int64
+	idle   bool
+}
+
+// notify invokes OnEvict or OnDrained for each key gc removed. It must be
+// called without holding s.store's lock, since callbacks may re-enter the
+// Cache or TokenBucket.
+func (s *shard) notify(removed []evictedKey) {
+	if len(removed) == 0 {
+		return
+	}
+
+	for _, ev := range removed {
+		if ev.idle {
+			s.owner.fireDrained(ev.key)
+		} else {
+			s.owner.fireEvict(ev.key, ev.tokens)
+		}
+	}
+}
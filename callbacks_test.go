@@ -0,0 +1,86 @@
+package leakybucket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnDrained(t *testing.T) {
+	c := NewSharded(10000, 1)
+
+	var mu sync.Mutex
+	var drained []uint64
+	c.OnDrained = func(key uint64) {
+		mu.Lock()
+		drained = append(drained, key)
+		mu.Unlock()
+	}
+
+	s := c.shards[0]
+	now := time.Now().UnixNano()
+
+	for n := 0; n < 10001; n++ {
+		_, _, _ = s.put(uint64(n), 0, 1000000000, now)
+	}
+
+	// Every bucket above stays at zero tokens (quantity 0, and now never
+	// advances), so anything gc removed should have been reported via
+	// OnDrained, not OnEvict.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotEmpty(t, drained)
+}
+
+func TestOnEvict(t *testing.T) {
+	c := NewSharded(10000, 1)
+
+	var mu sync.Mutex
+	var evicted []uint64
+	c.OnEvict = func(key uint64, tokens int64) {
+		mu.Lock()
+		evicted = append(evicted, key)
+		mu.Unlock()
+	}
+
+	s := c.shards[0]
+	now := time.Now().UnixNano()
+
+	// Every bucket stays full, so nothing drains naturally; gc's forced
+	// fallback must report these as OnEvict, not OnDrained.
+	for n := 0; n < 10001; n++ {
+		_, _, _ = s.put(uint64(n), 1000000000, 1000000000, now)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotEmpty(t, evicted)
+}
+
+func TestCallbacksRunUnlocked(t *testing.T) {
+	c := NewSharded(10000, 1)
+
+	// Re-entering the Cache from inside a callback must not deadlock.
+	c.OnEvict = func(key uint64, tokens int64) {
+		_, _, _ = c.Put(key, 1, 1000000000)
+	}
+
+	s := c.shards[0]
+	now := time.Now().UnixNano()
+
+	done := make(chan struct{})
+	go func() {
+		for n := 0; n < 10001; n++ {
+			_, _, _ = s.put(uint64(n), 1000000000, 1000000000, now)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback re-entering the Cache deadlocked")
+	}
+}
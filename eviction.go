@@ -0,0 +1,112 @@
+package leakybucket
+
+// EvictionPolicy selects how a Cache chooses what to remove from a shard
+// that's grown past MaxEntries.
+type EvictionPolicy int
+
+const (
+	// EvictRandom samples random parts of the store looking for drained
+	// buckets, falling back to deleting arbitrary keys. This is the
+	// original, zero-value behavior.
+	EvictRandom EvictionPolicy = iota
+
+	// EvictApproxLRU sweeps a CLOCK-style hand across the keys a shard
+	// has seen, clearing a "recently used" flag as it passes each one and
+	// evicting the first drained entry it finds with the flag already
+	// clear. This avoids evicting hot keys under adversarial or
+	// steady-hot-key workloads, at the cost of the hand's O(entries)
+	// bookkeeping.
+	EvictApproxLRU
+)
+
+// track records that k is a key the shard knows about, for EvictApproxLRU's
+// sweep. It's a no-op under other policies. The caller must hold
+// s.store's lock.
+func (s *shard) track(k uint64) {
+	if s.owner.evictionPolicy() == EvictApproxLRU {
+		s.evictHand = append(s.evictHand, k)
+	}
+}
+
+// gcApproxLRU frees up space by sweeping the CLOCK hand across evictHand,
+// clearing recently-used flags and evicting drained, already-cleared
+// entries. The caller must hold s.store's lock.
+func (s *shard) gcApproxLRU(now int64) []evictedKey {
+	need := s.store.Len() - (s.MaxEntries - gcMustRemoveEntries)
+	if need <= 0 {
+		return nil
+	}
+
+	// First pass: evict anything already idle and not recently used,
+	// clearing flags on everything else as the hand passes it.
+	removed := s.sweepApproxLRU(now, need)
+	if len(removed) >= need {
+		return removed
+	}
+
+	// Second pass: entries the hand already cleared on the first lap are
+	// now evictable if they've since drained.
+	removed = append(removed, s.sweepApproxLRU(now, need-len(removed))...)
+	if len(removed) >= need {
+		return removed
+	}
+
+	// Still short: force-evict tracked keys in hand order, starting where
+	// the hand stopped, regardless of recency or remaining tokens.
+	for left := need - len(removed); left > 0 && len(s.evictHand) > 0; left-- {
+		if s.hand >= len(s.evictHand) {
+			s.hand = 0
+		}
+		k := s.evictHand[s.hand]
+		e, _ := s.store.Get(k)
+		e = s.decay(e, now)
+		s.store.Delete(k)
+		s.evictHand = append(s.evictHand[:s.hand], s.evictHand[s.hand+1:]...)
+		removed = append(removed, evictedKey{key: k, tokens: e.tokens, idle: s.idle(e)})
+	}
+
+	return removed
+}
+
+// sweepApproxLRU advances the CLOCK hand up to once per tracked key,
+// evicting up to need drained, not-recently-used entries. The caller must
+// hold s.store's lock.
+func (s *shard) sweepApproxLRU(now int64, need int) []evictedKey {
+	var removed []evictedKey
+	steps := len(s.evictHand)
+
+	for len(removed) < need && steps > 0 {
+		steps--
+
+		if len(s.evictHand) == 0 {
+			break
+		}
+		if s.hand >= len(s.evictHand) {
+			s.hand = 0
+		}
+
+		k := s.evictHand[s.hand]
+		e, exists := s.store.Get(k)
+		if !exists {
+			// Stale reference to an already-evicted key.
+			s.evictHand = append(s.evictHand[:s.hand], s.evictHand[s.hand+1:]...)
+			continue
+		}
+		e = s.decay(e, now)
+
+		switch {
+		case e.recentlyUsed():
+			e = e.withRecentlyUsed(false)
+			s.store.Set(k, e)
+			s.hand++
+		case s.idle(e):
+			s.store.Delete(k)
+			s.evictHand = append(s.evictHand[:s.hand], s.evictHand[s.hand+1:]...)
+			removed = append(removed, evictedKey{key: k, tokens: e.tokens, idle: true})
+		default:
+			s.hand++
+		}
+	}
+
+	return removed
+}
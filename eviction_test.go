@@ -0,0 +1,66 @@
+package leakybucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func singleApproxLRU(maxEntries int) *Cache {
+	c := NewSharded(maxEntries, 1)
+	c.EvictionPolicy = EvictApproxLRU
+	return c
+}
+
+func TestApproxLRUEvictsIdleBeforeHot(t *testing.T) {
+	c := singleApproxLRU(10000)
+	s := c.shards[0]
+
+	now := time.Now().UnixNano()
+
+	// Fill the shard, then pretend a previous sweep already passed over
+	// every key, clearing their recently-used flags.
+	for n := uint64(0); n < 10000; n++ {
+		_, _, _ = s.put(n, 1000, 1000000000, now)
+		e, _ := s.store.Get(n)
+		e = e.withRecentlyUsed(false)
+		s.store.Set(n, e)
+	}
+
+	// Drain every bucket, then touch the first 100 keys again so only
+	// their recently-used flag is set.
+	now += 1000
+	for n := uint64(0); n < 100; n++ {
+		_, _, _ = s.put(n, 1, 1000000000, now)
+	}
+
+	// One more key triggers gc under MaxEntries pressure.
+	_, _, _ = s.put(100000, 1, 1000000000, now)
+
+	for n := uint64(0); n < 100; n++ {
+		_, exists := s.store.Get(n)
+		assert.True(t, exists, "recently-used key %d should survive eviction", n)
+	}
+	assert.InDelta(t, 10000-100, s.store.Len(), 10)
+}
+
+func TestApproxLRUForcedEviction(t *testing.T) {
+	c := singleApproxLRU(10000)
+	s := c.shards[0]
+
+	now := time.Now().UnixNano()
+
+	// Every key stays full and recently used, so nothing is naturally
+	// evictable; gc must fall back to forced eviction by hand order.
+	for n := 0; n < 10001; n++ {
+		_, _, _ = s.put(uint64(n), 1000000000, 1000000000, now)
+	}
+
+	assert.Equal(t, 10000-gcMustRemoveEntries, s.store.Len())
+}
+
+func TestEvictionPolicyDefaultIsRandom(t *testing.T) {
+	c := New(10000)
+	assert.Equal(t, EvictRandom, c.EvictionPolicy)
+}
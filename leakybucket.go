@@ -2,7 +2,8 @@ package leakybucket
 
 import (
 	"hash/fnv"
-	"sync"
+	"math"
+	"math/bits"
 	"time"
 )
 
@@ -11,37 +12,233 @@ const (
 	DrainPerSecond      = 1000000000
 	gcScanEntries       = 1000
 	gcMustRemoveEntries = 100
+
+	// defaultShards is the number of shards used by New. It must be a
+	// power of two.
+	defaultShards = 16
 )
 
-type entry struct {
+// entryRecentlyUsedBit is stolen from the sign bit of Entry.updated to
+// hold EvictApproxLRU's recently-used flag. Unix nanosecond timestamps
+// don't need it: the bit only turns negative in the year 2262.
+const entryRecentlyUsedBit = math.MinInt64
+
+// Entry is a Store's view of one bucket. The exported accessors and
+// NewEntry let an out-of-package Store implementation (Redis, memcached,
+// a peer-forwarding backend, ...) round-trip bucket state without
+// depending on this package's internals.
+type Entry struct {
 	tokens  int64 // one billion drained per second
-	updated int64 // unix nanoseconds
+	updated int64 // unix nanoseconds, with entryRecentlyUsedBit borrowed for EvictApproxLRU
+}
+
+// NewEntry builds the Entry for a bucket holding tokens tokens as of
+// updated (unix nanoseconds), for a Store implementation to return from
+// Get or Range.
+func NewEntry(tokens, updated int64) Entry {
+	return Entry{tokens: tokens, updated: updated &^ entryRecentlyUsedBit}
+}
+
+// Tokens is the number of tokens the bucket held as of UpdatedNano.
+func (e Entry) Tokens() int64 {
+	return e.tokens
+}
+
+// UpdatedNano is the unix nanosecond timestamp the bucket was last
+// updated at.
+func (e Entry) UpdatedNano() int64 {
+	return e.updated &^ entryRecentlyUsedBit
+}
+
+// recentlyUsed reports whether this entry has been put or taken since
+// EvictApproxLRU's sweep last cleared its flag.
+func (e Entry) recentlyUsed() bool {
+	return e.updated&entryRecentlyUsedBit != 0
+}
+
+// withRecentlyUsed returns a copy of e with its recently-used flag set to
+// used.
+func (e Entry) withRecentlyUsed(used bool) Entry {
+	if used {
+		e.updated |= entryRecentlyUsedBit
+	} else {
+		e.updated &^= entryRecentlyUsedBit
+	}
+	return e
 }
 
 // Cache is a size-limited hash-map implementation of the leaky
 // bucket rate-limiting algorithm. Entries are roughly 78 bytes each.
+//
+// Keys are distributed across a power-of-two number of independently
+// locked shards, so that concurrent callers touching different keys
+// don't contend on the same mutex.
 type Cache struct {
 	MaxEntries int
 
-	mu      sync.Mutex
-	cache   map[uint64]entry
-	entries int
+	// Limit is the per-bucket token limit used by Take and TakeString,
+	// which satisfy the Bucket interface. Put and PutString ignore it and
+	// accept a limit per call instead.
+	Limit int64
+
+	// EvictionPolicy selects how shards choose what to evict under
+	// MaxEntries pressure. The zero value, EvictRandom, is today's
+	// behavior. Set it before the Cache receives any Put calls:
+	// EvictApproxLRU only tracks keys added while it is selected.
+	EvictionPolicy EvictionPolicy
+
+	// OnEvict, if set, is called after gc forcibly removes a key that
+	// still had tokens, due to MaxEntries pressure.
+	OnEvict func(key uint64, tokens int64)
+
+	// OnDrained, if set, is called after gc removes a key because its
+	// bucket had fully drained.
+	OnDrained func(key uint64)
+
+	shards    []*shard
+	shardBits uint
+}
+
+// shardOwner is what a shard needs from the Cache or TokenBucket holding
+// it: the EvictionPolicy to gc under, and somewhere to report removed
+// keys once gc's done. Both Cache and TokenBucket implement it so they
+// can share shard's Store + gc machinery.
+type shardOwner interface {
+	evictionPolicy() EvictionPolicy
+	fireEvict(key uint64, tokens int64)
+	fireDrained(key uint64)
+}
+
+// shard is one independently-synchronized partition of a Cache or
+// TokenBucket, backed by a Store.
+type shard struct {
+	MaxEntries int
+
+	store Store
+	owner shardOwner // owning Cache or TokenBucket, for EvictionPolicy and the OnEvict/OnDrained callbacks
+
+	// rate is how many tokens an idle entry gains per second; negative
+	// drains instead of refilling. capacity caps how high rate can refill
+	// an entry; it's 0 (unbounded) for a draining shard. See decay/idle.
+	rate     int64
+	capacity int64
+
+	// evictHand and hand implement the CLOCK sweep used by
+	// EvictApproxLRU; see eviction.go. They're unused under EvictRandom.
+	evictHand []uint64
+	hand      int
+}
+
+// decay brings e's tokens up to date as of now, draining or refilling at
+// s.rate tokens/sec and clamping to [0, s.capacity] (no upper clamp if
+// s.capacity is 0).
+func (s *shard) decay(e Entry, now int64) Entry {
+	elapsed := now - e.UpdatedNano()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	tokens := e.tokens + elapsed*s.rate/DrainPerSecond
+	if tokens < 0 {
+		tokens = 0
+	}
+	if s.capacity > 0 && tokens > s.capacity {
+		tokens = s.capacity
+	}
+
+	return Entry{tokens: tokens, updated: now}.withRecentlyUsed(e.recentlyUsed())
 }
 
-// New creates a Cache capable of storing up to maxEntries entries.
+// idle reports whether e no longer needs tracking: fully drained for a
+// draining shard, or refilled back to capacity for a refilling one.
+func (s *shard) idle(e Entry) bool {
+	if s.rate < 0 {
+		return e.tokens <= 0
+	}
+	return s.capacity > 0 && e.tokens >= s.capacity
+}
+
+// New creates a Cache capable of storing up to maxEntries entries,
+// sharded across defaultShards in-memory shards.
 func New(maxEntries int) *Cache {
-	if maxEntries <= 0 {
+	return NewSharded(maxEntries, defaultShards)
+}
+
+// NewSharded creates a Cache capable of storing up to maxEntries entries,
+// spread evenly across shards independently-locked, in-memory shards.
+// shards must be a power of two; maxEntries is divided evenly between
+// them. Higher shard counts reduce mutex contention under concurrent
+// access at the cost of a slightly less precise global MaxEntries bound.
+func NewSharded(maxEntries, shards int) *Cache {
+	if maxEntries <= 0 || shards <= 0 || shards&(shards-1) != 0 {
+		return nil
+	}
+
+	perShard := maxEntries / shards
+	if perShard <= 0 {
+		perShard = 1
+	}
+
+	b := &Cache{
+		MaxEntries: perShard * shards,
+		shards:     make([]*shard, shards),
+		shardBits:  uint(bits.TrailingZeros(uint(shards))),
+	}
+
+	for i := range b.shards {
+		b.shards[i] = &shard{
+			MaxEntries: perShard,
+			store:      NewMemStore(),
+			owner:      b,
+			rate:       -DrainPerSecond,
+		}
+	}
+
+	return b
+}
+
+// NewWithStore creates a single-shard Cache capable of storing up to
+// maxEntries entries, backed by store instead of an in-memory map. This is
+// how callers plug in a distributed backend (Redis, memcached, a
+// peer-forwarding store, ...) without forking the rate-limiting algorithm.
+// Any sharding or distribution of keys is left to store.
+func NewWithStore(store Store, maxEntries int) *Cache {
+	if store == nil || maxEntries <= 0 {
 		return nil
 	}
 
 	b := &Cache{
 		MaxEntries: maxEntries,
-		cache:      make(map[uint64]entry),
 	}
+	b.shards = []*shard{{
+		MaxEntries: maxEntries,
+		store:      store,
+		owner:      b,
+		rate:       -DrainPerSecond,
+	}}
 
 	return b
 }
 
+func (lb *Cache) evictionPolicy() EvictionPolicy { return lb.EvictionPolicy }
+
+func (lb *Cache) fireEvict(key uint64, tokens int64) {
+	if lb.OnEvict != nil {
+		lb.OnEvict(key, tokens)
+	}
+}
+
+func (lb *Cache) fireDrained(key uint64) {
+	if lb.OnDrained != nil {
+		lb.OnDrained(key)
+	}
+}
+
+// shardFor returns the shard responsible for k, selected by its top bits.
+func (lb *Cache) shardFor(k uint64) *shard {
+	return lb.shards[k>>(64-lb.shardBits)]
+}
+
 // Put attempts to add quantity tokens into the bucket referred to by a
 // uint64 key that has a size limit of limit tokens.  Return the current
 // number of tokens in the bucket, whether the key already existed, and
@@ -49,12 +246,7 @@ func New(maxEntries int) *Cache {
 // of tokens.
 func (lb *Cache) Put(key uint64, quantity, limit int64) (int64, bool, bool) {
 	now := time.Now().UnixNano()
-
-	lb.mu.Lock()
-	tokens, exists, ok := lb.put(key, quantity, limit, now)
-	lb.mu.Unlock()
-
-	return tokens, exists, ok
+	return lb.shardFor(key).put(key, quantity, limit, now)
 }
 
 // PutString attempt to add quantity tokens into the bucket referred to the
@@ -63,14 +255,7 @@ func (lb *Cache) Put(key uint64, quantity, limit int64) (int64, bool, bool) {
 // whether there was enough room in the bucket to add the requested number
 // of tokens.
 func (lb *Cache) PutString(ks string, quantity, limit int64) (int64, bool, bool) {
-	k := key(ks)
-	now := time.Now().UnixNano()
-
-	lb.mu.Lock()
-	tokens, exists, ok := lb.put(k, quantity, limit, now)
-	lb.mu.Unlock()
-
-	return tokens, exists, ok
+	return lb.Put(key(ks), quantity, limit)
 }
 
 func key(k string) uint64 {
@@ -79,94 +264,113 @@ func key(k string) uint64 {
 	return h.Sum64()
 }
 
-func (lb *Cache) put(k uint64, quantity, limit, now int64) (int64, bool, bool) {
-	e, exists := lb.cache[k]
+// entries returns the total number of entries cached across all shards.
+func (lb *Cache) entries() int {
+	n := 0
+	for _, s := range lb.shards {
+		s.store.Lock()
+		n += s.store.Len()
+		s.store.Unlock()
+	}
+	return n
+}
+
+func (s *shard) put(k uint64, quantity, limit, now int64) (int64, bool, bool) {
+	s.store.Lock()
+
+	e, exists := s.store.Get(k)
 	if exists {
-		e = e.update(now)
+		e = s.decay(e, now)
 	} else {
-		e = entry{tokens: 0, updated: now}
+		e = Entry{tokens: 0, updated: now}
 	}
 
 	ok := e.tokens+quantity <= limit
 	if ok {
 		e.tokens += quantity
 	}
-	lb.cache[k] = e
+	e = e.withRecentlyUsed(true)
+	s.store.Set(k, e)
 
+	var removed []evictedKey
 	if !exists {
-		lb.entries++
-		if lb.entries > lb.MaxEntries {
-			lb.gc(now)
+		s.track(k)
+		if s.store.Len() > s.MaxEntries {
+			removed = s.gc(now)
 		}
 	}
 
+	s.store.Unlock()
+
+	// Callbacks may re-enter the Cache, so they must run unlocked.
+	s.notify(removed)
+
 	return e.tokens, exists, ok
 }
 
-// gc frees up space in the map, forcibly if necessary.
-func (lb *Cache) gc(now int64) {
-	left := lb.entries - (lb.MaxEntries - gcMustRemoveEntries)
+// gc frees up space in the shard's store, forcibly if necessary, using
+// whichever EvictionPolicy the owning Cache or TokenBucket is set to. The
+// caller must hold s.store's lock.
+func (s *shard) gc(now int64) []evictedKey {
+	if s.owner.evictionPolicy() == EvictApproxLRU {
+		return s.gcApproxLRU(now)
+	}
+	return s.gcRandom(now)
+}
+
+// gcRandom frees up space using the original probabilistic scan: sample
+// random parts of the store for idle entries, falling back to deleting
+// arbitrary keys. The caller must hold s.store's lock.
+func (s *shard) gcRandom(now int64) []evictedKey {
+	left := s.store.Len() - (s.MaxEntries - gcMustRemoveEntries)
 
-	// Try freeing up entries in a random part of the map.
-	left -= lb.scan(now, gcScanEntries)
+	// Try freeing up entries in a random part of the store.
+	freed, removed := s.scan(now, gcScanEntries)
+	left -= freed
 	if left <= 0 {
-		return
+		return removed
 	}
 
-	// If that failed, try one more time in a different part of the map.
-	left -= lb.scan(now, gcScanEntries)
+	// If that failed, try one more time in a different part of the store.
+	freed, more := s.scan(now, gcScanEntries)
+	removed = append(removed, more...)
+	left -= freed
 	if left <= 0 {
-		return
+		return removed
 	}
 
 	// If that failed, just delete some keys.
-	for k := range lb.cache {
-		delete(lb.cache, k)
-		lb.entries--
+	s.store.Range(func(k uint64, e Entry) bool {
+		e = s.decay(e, now)
+		s.store.Delete(k)
+		removed = append(removed, evictedKey{key: k, tokens: e.tokens, idle: s.idle(e)})
 		left--
-		if left <= 0 {
-			return
-		}
-	}
+		return left > 0
+	})
+
+	return removed
 }
 
-// scan attempts to find buckets which are empty to delete.
-func (lb *Cache) scan(now int64, count int) int {
-	start := lb.entries
+// scan attempts to find idle entries to delete. The caller must hold
+// s.store's lock.
+func (s *shard) scan(now int64, count int) (int, []evictedKey) {
+	start := s.store.Len()
 
+	var removed []evictedKey
 	n := 0
-	for k, e := range lb.cache {
-		e = e.update(now)
+	s.store.Range(func(k uint64, e Entry) bool {
+		e = s.decay(e, now)
 
-		if e.tokens <= 0 {
-			delete(lb.cache, k)
-			lb.entries--
+		if s.idle(e) {
+			s.store.Delete(k)
+			removed = append(removed, evictedKey{key: k, tokens: e.tokens, idle: true})
 		} else {
-			lb.cache[k] = e
+			s.store.Set(k, e)
 		}
 
 		n++
-		if n >= count {
-			break
-		}
-	}
-
-	return lb.entries - start
-}
-
-// update drains a bucket according to how much time as elapsed since last update.
-func (e entry) update(now int64) entry {
-	// How many nanoseconds have elapsed since last update?
-	s := now - e.updated
-	if s < 0 {
-		s = 0
-	}
-
-	// Drain one token per elapsed nanosecond.
-	t := e.tokens - s
-	if t < 0 {
-		t = 0
-	}
+		return n < count
+	})
 
-	return entry{tokens: t, updated: now}
+	return s.store.Len() - start, removed
 }
@@ -20,28 +20,37 @@ var entries = []struct {
 	{5, 50000000},
 }
 
+// single returns a Cache with a single shard, so that tests can exercise
+// the underlying map deterministically.
+func single(maxEntries int) *Cache {
+	return NewSharded(maxEntries, 1)
+}
+
 func TestPut(t *testing.T) {
-	b := New(10000)
+	b := single(10000)
+	s := b.shards[0]
 
 	now := time.Now().UnixNano()
 
 	// Add the test entries
 	for _, e := range entries {
-		tokens, exists, ok := b.put(e.key, e.value, 1000000000, now)
+		tokens, exists, ok := s.put(e.key, e.value, 1000000000, now)
 		assert.Equal(t, e.value, tokens)
 		assert.False(t, exists)
 		assert.True(t, ok)
 	}
 
-	assert.Equal(t, 5, b.entries)
+	assert.Equal(t, 5, s.store.Len())
 
 	// Fast-forward time by 500ns, gc, and verify that the entries have
 	// reasonable values.
 	now += 500
-	b.gc(now)
+	s.store.Lock()
+	s.gc(now)
+	s.store.Unlock()
 
 	for _, e := range entries {
-		tokens, exists, ok := b.put(e.key, 1, 1000000000, now)
+		tokens, exists, ok := s.put(e.key, 1, 1000000000, now)
 		assert.Equal(t, e.value-500+1, tokens)
 		assert.True(t, exists)
 		assert.True(t, ok)
@@ -50,52 +59,89 @@ func TestPut(t *testing.T) {
 	// Fast-forward time by another 2000ns, gc, and check that we've
 	// freed 2 entries.
 	now += 2000
-	b.gc(now)
-	assert.Equal(t, 3, b.entries)
+	s.store.Lock()
+	s.gc(now)
+	s.store.Unlock()
+	assert.Equal(t, 3, s.store.Len())
 }
 
 func TestPutString(t *testing.T) {
-	b := New(10000)
+	b := single(10000)
 
 	_, _, _ = b.PutString("1", 1000, 1000000000)
 	_, _, _ = b.PutString("2", 2000, 1000000000)
 	_, _, _ = b.PutString("2", 500, 1000000000)
 
-	assert.Equal(t, 2, b.entries)
+	assert.Equal(t, 2, b.entries())
 }
 
 func TestGC(t *testing.T) {
-	b := New(10000)
+	b := single(10000)
+	s := b.shards[0]
 
 	now := time.Now().UnixNano()
 
 	// Add one too many entries and make sure we removed gcMustRemoveEntries.
 	for n := 0; n < 10001; n++ {
-		_, _, _ = b.put(uint64(n), int64(1000+n), 1000000000, now)
+		_, _, _ = s.put(uint64(n), int64(1000+n), 1000000000, now)
 	}
 
-	assert.Equal(t, 10000-gcMustRemoveEntries, b.entries)
+	assert.Equal(t, 10000-gcMustRemoveEntries, s.store.Len())
 
 	// Fast forward 2000ns, add another 200 entries, and make sure we
 	// did more GC.
 	now += 2000
 
 	for n := 10002; n < 10200; n++ {
-		_, _, _ = b.put(uint64(n), int64(1000+n), 1000000000, now)
+		_, _, _ = s.put(uint64(n), int64(1000+n), 1000000000, now)
 	}
 
-	assert.InDelta(t, 9600, b.entries, 200)
+	assert.InDelta(t, 9600, s.store.Len(), 200)
 }
 
 func TestMaxEntries(t *testing.T) {
-	c := New(2)
+	c := single(2)
 
 	for _, e := range entries {
 		_, _, _ = c.Put(e.key, e.value, 100000000)
 	}
 
 	// Make sure only the last two entries were kept.
-	assert.Equal(t, 2, c.entries)
+	assert.Equal(t, 2, c.entries())
+}
+
+func TestNewSharded(t *testing.T) {
+	assert.Nil(t, NewSharded(0, 16))
+	assert.Nil(t, NewSharded(100, 0))
+	assert.Nil(t, NewSharded(100, 3)) // not a power of two
+
+	c := NewSharded(1600, 16)
+	assert.Len(t, c.shards, 16)
+	assert.Equal(t, 100, c.shards[0].MaxEntries)
+}
+
+func TestShardFor(t *testing.T) {
+	c := NewSharded(160, 16)
+
+	// Keys whose top 4 bits differ must land in different shards.
+	low := c.shardFor(0x0000000000000001)
+	high := c.shardFor(0xf000000000000001)
+	assert.NotSame(t, low, high)
+}
+
+func TestNewWithStore(t *testing.T) {
+	assert.Nil(t, NewWithStore(nil, 10000))
+	assert.Nil(t, NewWithStore(NewMemStore(), 0))
+
+	c := NewWithStore(NewMemStore(), 2)
+
+	for _, e := range entries {
+		_, _, _ = c.Put(e.key, e.value, 100000000)
+	}
+
+	// Make sure only the last two entries were kept, same as a single
+	// in-memory shard.
+	assert.Equal(t, 2, c.entries())
 }
 
 func TestRace(t *testing.T) {
@@ -118,14 +164,15 @@ func TestOverhead(t *testing.T) {
 	}
 
 	num := 100000
-	c := New(num)
+	c := single(num)
+	s := c.shards[0]
 
 	now := time.Now().UnixNano()
 
 	mem := readMem()
 
 	for n := 0; n < num*4; n++ {
-		_, _, _ = c.put(uint64(n), int64(n), int64(n), now)
+		_, _, _ = s.put(uint64(n), int64(n), int64(n), now)
 	}
 
 	mem = readMem() - mem
@@ -138,3 +185,17 @@ func readMem() int64 {
 	runtime.ReadMemStats(&m)
 	return int64(m.Alloc)
 }
+
+// BenchmarkPut exercises concurrent Put calls across the default sharding.
+// Run with `go test -bench=Put -cpu=2,4,8,16` to see how throughput scales
+// with GOMAXPROCS now that shards no longer share a single mutex.
+func BenchmarkPut(b *testing.B) {
+	c := New(100000)
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(1))
+		for pb.Next() {
+			_, _, _ = c.Put(uint64(r.Int31n(100000)), r.Int63n(1000000000), 1000000000)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package leakybucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStillFull is returned by Wait if, after the computed delay elapsed,
+// another caller had already refilled the bucket.
+var ErrStillFull = errors.New("leakybucket: bucket still full after waiting")
+
+// Reserve computes how long the caller must wait for quantity tokens to
+// fit in the bucket referred to by key, which has a size limit of limit
+// tokens, without adding them. If the bucket already has room, delay is
+// zero. ok is false only if quantity itself exceeds limit, so the
+// reservation could never be satisfied no matter how long the caller
+// waits.
+//
+// Reserve does not mutate the bucket; pair it with a later Put, or use
+// Wait, to actually consume the tokens once delay has elapsed.
+func (lb *Cache) Reserve(key uint64, quantity, limit int64) (delay time.Duration, ok bool) {
+	if quantity > limit {
+		return 0, false
+	}
+
+	now := time.Now().UnixNano()
+
+	s := lb.shardFor(key)
+	s.store.Lock()
+	e, exists := s.store.Get(key)
+	s.store.Unlock()
+
+	if exists {
+		e = s.decay(e, now)
+	}
+
+	// Tokens drain at one per nanosecond, so the overflow is already in
+	// nanoseconds.
+	need := e.tokens + quantity - limit
+	if need <= 0 {
+		return 0, true
+	}
+
+	return time.Duration(need), true
+}
+
+// Wait blocks until quantity tokens are available in the bucket referred
+// to by key, which has a size limit of limit tokens, then adds them. It
+// returns an error without waiting if quantity exceeds limit, returns early
+// with ctx.Err() if ctx is canceled before then, and returns ErrStillFull
+// if the tokens still don't fit once the delay has elapsed.
+func (lb *Cache) Wait(ctx context.Context, key uint64, quantity, limit int64) error {
+	delay, ok := lb.Reserve(key, quantity, limit)
+	if !ok {
+		return fmt.Errorf("leakybucket: requested quantity %d exceeds limit %d", quantity, limit)
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if _, _, ok := lb.Put(key, quantity, limit); !ok {
+		return ErrStillFull
+	}
+
+	return nil
+}
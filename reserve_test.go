@@ -0,0 +1,71 @@
+package leakybucket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReserve(t *testing.T) {
+	c := New(10000)
+
+	// A fresh bucket has room immediately.
+	delay, ok := c.Reserve(1, 400000000, 1000000000)
+	assert.Zero(t, delay)
+	assert.True(t, ok)
+
+	// Reserve must not have mutated the bucket.
+	tokens, exists, ok := c.Put(1, 0, 1000000000)
+	assert.Equal(t, int64(0), tokens)
+	assert.False(t, exists)
+	assert.True(t, ok)
+
+	// Fill the bucket, then ask for more than fits.
+	_, _, _ = c.Put(1, 1000000000, 1000000000)
+	delay, ok = c.Reserve(1, 500000000, 1000000000)
+	assert.True(t, ok)
+	assert.InDelta(t, 500*time.Millisecond, delay, float64(10*time.Millisecond))
+
+	// A quantity bigger than the limit can never be satisfied.
+	delay, ok = c.Reserve(1, 2000000000, 1000000000)
+	assert.Zero(t, delay)
+	assert.False(t, ok)
+}
+
+func TestWait(t *testing.T) {
+	c := New(10000)
+
+	_, _, _ = c.Put(2, 900000000, 1000000000)
+
+	start := time.Now()
+	err := c.Wait(context.Background(), 2, 200000000, 1000000000)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, start.Add(100*time.Millisecond), time.Now(), 50*time.Millisecond)
+
+	// The wait committed the reservation.
+	tokens, exists, ok := c.Put(2, 0, 1000000000)
+	assert.True(t, exists)
+	assert.True(t, ok)
+	assert.InDelta(t, 1000000000, tokens, 10000000)
+}
+
+func TestWaitExceedsLimit(t *testing.T) {
+	c := New(10000)
+
+	err := c.Wait(context.Background(), 3, 2000000000, 1000000000)
+	assert.Error(t, err)
+}
+
+func TestWaitContextCanceled(t *testing.T) {
+	c := New(10000)
+
+	_, _, _ = c.Put(4, 1000000000, 1000000000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := c.Wait(ctx, 4, 1000000000, 1000000000)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,71 @@
+package leakybucket
+
+import "sync"
+
+// Store is the storage backend behind a Cache shard. It lets the leaky
+// bucket algorithm run against something other than an in-process map,
+// for example a Redis-backed or peer-forwarding implementation for
+// distributed rate limiting. Implementations own their own
+// synchronization: Lock/Unlock bracket each read-modify-write done by a
+// Cache, so a distributed Store can use its own locking or transactions
+// instead.
+type Store interface {
+	Lock()
+	Unlock()
+
+	// Get returns the Entry for key, if any.
+	Get(key uint64) (Entry, bool)
+
+	// Set stores the Entry for key, creating or overwriting it.
+	Set(key uint64, e Entry)
+
+	// Delete removes key, if present.
+	Delete(key uint64)
+
+	// Range calls fn for entries in the store, in no particular order,
+	// until fn returns false or every Entry has been visited. This is the
+	// primitive the probabilistic scan GC uses to sample the store.
+	Range(fn func(key uint64, e Entry) bool)
+
+	// Len returns the number of entries currently stored.
+	Len() int
+}
+
+// MemStore is the default, in-process Store: a map guarded by a mutex.
+type MemStore struct {
+	mu    sync.Mutex
+	cache map[uint64]Entry
+}
+
+// NewMemStore creates an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{cache: make(map[uint64]Entry)}
+}
+
+func (m *MemStore) Lock()   { m.mu.Lock() }
+func (m *MemStore) Unlock() { m.mu.Unlock() }
+
+func (m *MemStore) Get(key uint64) (Entry, bool) {
+	e, ok := m.cache[key]
+	return e, ok
+}
+
+func (m *MemStore) Set(key uint64, e Entry) {
+	m.cache[key] = e
+}
+
+func (m *MemStore) Delete(key uint64) {
+	delete(m.cache, key)
+}
+
+func (m *MemStore) Range(fn func(key uint64, e Entry) bool) {
+	for k, e := range m.cache {
+		if !fn(k, e) {
+			return
+		}
+	}
+}
+
+func (m *MemStore) Len() int {
+	return len(m.cache)
+}
@@ -0,0 +1,50 @@
+package leakybucket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemStore(t *testing.T) {
+	m := NewMemStore()
+
+	_, ok := m.Get(1)
+	assert.False(t, ok)
+
+	m.Set(1, NewEntry(100, 1))
+	e, ok := m.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), e.Tokens())
+	assert.Equal(t, int64(1), e.UpdatedNano())
+	assert.Equal(t, 1, m.Len())
+
+	m.Set(2, NewEntry(200, 2))
+	assert.Equal(t, 2, m.Len())
+
+	seen := map[uint64]Entry{}
+	m.Range(func(k uint64, e Entry) bool {
+		seen[k] = e
+		return true
+	})
+	assert.Len(t, seen, 2)
+
+	m.Delete(1)
+	_, ok = m.Get(1)
+	assert.False(t, ok)
+	assert.Equal(t, 1, m.Len())
+}
+
+func TestMemStoreRangeStop(t *testing.T) {
+	m := NewMemStore()
+	for k := uint64(0); k < 10; k++ {
+		m.Set(k, NewEntry(int64(k), 0))
+	}
+
+	n := 0
+	m.Range(func(k uint64, e Entry) bool {
+		n++
+		return n < 3
+	})
+	assert.Equal(t, 3, n)
+}
@@ -0,0 +1,193 @@
+package leakybucket
+
+import (
+	"math/bits"
+	"time"
+)
+
+// Bucket is implemented by both Cache, which meters tokens out of a
+// draining bucket, and TokenBucket, which hands tokens out of a bucket
+// that refills over time. It lets callers pick whichever rate-limiting
+// algorithm suits them without changing call sites.
+type Bucket interface {
+	// Take attempts to spend quantity tokens against the bucket referred
+	// to by key, returning the bucket's token count afterwards and whether
+	// the request was allowed. For TokenBucket that count is the tokens
+	// still available; for Cache it is the tokens the bucket now holds.
+	Take(key uint64, quantity int64) (remaining int64, ok bool)
+
+	// TakeString is Take for a string key.
+	TakeString(ks string, quantity int64) (remaining int64, ok bool)
+}
+
+// Take adds quantity tokens to the bucket referred to by key, capped at
+// lb.Limit, returning the bucket's current token count and whether there
+// was room. It lets Cache satisfy Bucket alongside the more flexible Put,
+// which accepts a per-call limit.
+func (lb *Cache) Take(key uint64, quantity int64) (int64, bool) {
+	tokens, _, ok := lb.Put(key, quantity, lb.Limit)
+	return tokens, ok
+}
+
+// TakeString is Take for a string key.
+func (lb *Cache) TakeString(ks string, quantity int64) (int64, bool) {
+	tokens, _, ok := lb.PutString(ks, quantity, lb.Limit)
+	return tokens, ok
+}
+
+// TokenBucket is a size-limited hash-map implementation of the classic
+// token-bucket rate-limiting algorithm: each key's bucket starts full at
+// Capacity tokens and refills at RefillPerSecond tokens/sec, up to
+// Capacity. Take succeeds only while enough tokens are available.
+//
+// Like Cache, keys are distributed across a power-of-two number of
+// independently locked shards, sharing the same shard/Store/gc machinery.
+type TokenBucket struct {
+	Capacity        int64
+	RefillPerSecond int64
+	MaxEntries      int
+
+	// EvictionPolicy selects how shards choose what to evict under
+	// MaxEntries pressure. See Cache.EvictionPolicy.
+	EvictionPolicy EvictionPolicy
+
+	// OnEvict, if set, is called after gc forcibly removes a key that
+	// hadn't yet refilled to Capacity, due to MaxEntries pressure.
+	OnEvict func(key uint64, tokens int64)
+
+	// OnDrained, if set, is called after gc removes a key because its
+	// bucket had refilled back to Capacity, and so was no longer
+	// rate-limiting anything.
+	OnDrained func(key uint64)
+
+	shards    []*shard
+	shardBits uint
+}
+
+// NewTokenBucket creates a TokenBucket with the given per-key capacity and
+// refill rate, capable of storing up to maxEntries keys, sharded across
+// defaultShards shards.
+func NewTokenBucket(capacity, refillPerSecond int64, maxEntries int) *TokenBucket {
+	return NewTokenBucketSharded(capacity, refillPerSecond, maxEntries, defaultShards)
+}
+
+// NewTokenBucketSharded is NewTokenBucket with an explicit, power-of-two
+// number of shards.
+func NewTokenBucketSharded(capacity, refillPerSecond int64, maxEntries, shards int) *TokenBucket {
+	if capacity <= 0 || refillPerSecond <= 0 || maxEntries <= 0 || shards <= 0 || shards&(shards-1) != 0 {
+		return nil
+	}
+
+	perShard := maxEntries / shards
+	if perShard <= 0 {
+		perShard = 1
+	}
+
+	b := &TokenBucket{
+		Capacity:        capacity,
+		RefillPerSecond: refillPerSecond,
+		MaxEntries:      perShard * shards,
+		shards:          make([]*shard, shards),
+		shardBits:       uint(bits.TrailingZeros(uint(shards))),
+	}
+
+	for i := range b.shards {
+		b.shards[i] = &shard{
+			MaxEntries: perShard,
+			store:      NewMemStore(),
+			owner:      b,
+			rate:       refillPerSecond,
+			capacity:   capacity,
+		}
+	}
+
+	return b
+}
+
+// NewTokenBucketWithStore creates a single-shard TokenBucket capable of
+// storing up to maxEntries keys, backed by store instead of an in-memory
+// map. See NewWithStore.
+func NewTokenBucketWithStore(store Store, capacity, refillPerSecond int64, maxEntries int) *TokenBucket {
+	if store == nil || capacity <= 0 || refillPerSecond <= 0 || maxEntries <= 0 {
+		return nil
+	}
+
+	b := &TokenBucket{
+		Capacity:        capacity,
+		RefillPerSecond: refillPerSecond,
+		MaxEntries:      maxEntries,
+	}
+	b.shards = []*shard{{
+		MaxEntries: maxEntries,
+		store:      store,
+		owner:      b,
+		rate:       refillPerSecond,
+		capacity:   capacity,
+	}}
+
+	return b
+}
+
+func (tb *TokenBucket) evictionPolicy() EvictionPolicy { return tb.EvictionPolicy }
+
+func (tb *TokenBucket) fireEvict(key uint64, tokens int64) {
+	if tb.OnEvict != nil {
+		tb.OnEvict(key, tokens)
+	}
+}
+
+func (tb *TokenBucket) fireDrained(key uint64) {
+	if tb.OnDrained != nil {
+		tb.OnDrained(key)
+	}
+}
+
+func (tb *TokenBucket) shardFor(k uint64) *shard {
+	return tb.shards[k>>(64-tb.shardBits)]
+}
+
+// Take attempts to remove quantity tokens from the bucket referred to by
+// key. Return the number of tokens remaining in the bucket and whether
+// there were enough tokens available.
+func (tb *TokenBucket) Take(key uint64, quantity int64) (int64, bool) {
+	now := time.Now().UnixNano()
+	return tb.shardFor(key).take(key, quantity, now)
+}
+
+// TakeString is Take for a string key.
+func (tb *TokenBucket) TakeString(ks string, quantity int64) (int64, bool) {
+	return tb.Take(key(ks), quantity)
+}
+
+func (s *shard) take(k uint64, quantity, now int64) (int64, bool) {
+	s.store.Lock()
+
+	e, exists := s.store.Get(k)
+	if exists {
+		e = s.decay(e, now)
+	} else {
+		e = Entry{tokens: s.capacity, updated: now}
+	}
+
+	ok := e.tokens >= quantity
+	if ok {
+		e.tokens -= quantity
+	}
+	e = e.withRecentlyUsed(true)
+	s.store.Set(k, e)
+
+	var removed []evictedKey
+	if !exists {
+		s.track(k)
+		if s.store.Len() > s.MaxEntries {
+			removed = s.gc(now)
+		}
+	}
+
+	s.store.Unlock()
+
+	// Callbacks may re-enter the TokenBucket, so they must run unlocked.
+	s.notify(removed)
+
+	return e.tokens, ok
+}
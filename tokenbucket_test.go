@@ -0,0 +1,143 @@
+package leakybucket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func singleTokenBucket(capacity, refillPerSecond int64, maxEntries int) *TokenBucket {
+	return NewTokenBucketSharded(capacity, refillPerSecond, maxEntries, 1)
+}
+
+func TestTake(t *testing.T) {
+	tb := singleTokenBucket(1000, 100, 10000)
+	s := tb.shards[0]
+
+	now := time.Now().UnixNano()
+
+	// A fresh bucket starts full.
+	remaining, ok := s.take(1, 400, now)
+	assert.Equal(t, int64(600), remaining)
+	assert.True(t, ok)
+
+	// Taking more than is left fails and leaves the bucket untouched.
+	remaining, ok = s.take(1, 700, now)
+	assert.Equal(t, int64(600), remaining)
+	assert.False(t, ok)
+
+	// After a second at 100/sec, 100 tokens have refilled.
+	now += DrainPerSecond
+	remaining, ok = s.take(1, 0, now)
+	assert.Equal(t, int64(700), remaining)
+	assert.True(t, ok)
+
+	// Refilling can never exceed capacity.
+	now += 100 * DrainPerSecond
+	remaining, ok = s.take(1, 0, now)
+	assert.Equal(t, int64(1000), remaining)
+	assert.True(t, ok)
+}
+
+func TestTakeString(t *testing.T) {
+	tb := singleTokenBucket(1000, 100, 10000)
+
+	_, ok := tb.TakeString("a", 100)
+	assert.True(t, ok)
+
+	remaining, ok := tb.TakeString("a", 100)
+	assert.Equal(t, int64(800), remaining)
+	assert.True(t, ok)
+}
+
+func TestTokenBucketGC(t *testing.T) {
+	tb := singleTokenBucket(1000, 1000000000, 10000)
+	s := tb.shards[0]
+
+	now := time.Now().UnixNano()
+
+	// Fill 10001 buckets, draining each so none are evictable by refill.
+	for n := 0; n < 10001; n++ {
+		_, _ = s.take(uint64(n), 1000, now)
+	}
+
+	assert.Equal(t, 10000-gcMustRemoveEntries, s.store.Len())
+}
+
+func TestNewTokenBucketSharded(t *testing.T) {
+	assert.Nil(t, NewTokenBucketSharded(0, 100, 10000, 16))
+	assert.Nil(t, NewTokenBucketSharded(1000, 0, 10000, 16))
+	assert.Nil(t, NewTokenBucketSharded(1000, 100, 0, 16))
+	assert.Nil(t, NewTokenBucketSharded(1000, 100, 10000, 3)) // not a power of two
+
+	tb := NewTokenBucket(1000, 100, 10000)
+	assert.Len(t, tb.shards, defaultShards)
+}
+
+func TestBucketInterface(t *testing.T) {
+	var _ Bucket = New(10000)
+	var _ Bucket = NewTokenBucket(1000, 100, 10000)
+}
+
+func TestNewTokenBucketWithStore(t *testing.T) {
+	assert.Nil(t, NewTokenBucketWithStore(nil, 1000, 100, 10000))
+	assert.Nil(t, NewTokenBucketWithStore(NewMemStore(), 0, 100, 10000))
+	assert.Nil(t, NewTokenBucketWithStore(NewMemStore(), 1000, 0, 10000))
+	assert.Nil(t, NewTokenBucketWithStore(NewMemStore(), 1000, 100, 0))
+
+	tb := NewTokenBucketWithStore(NewMemStore(), 1000, 100, 10000)
+
+	remaining, ok := tb.Take(1, 400)
+	assert.Equal(t, int64(600), remaining)
+	assert.True(t, ok)
+}
+
+// TestTokenBucketCallbacks exercises the same shared shard/gc machinery
+// Cache's OnEvict/OnDrained use, but from TokenBucket: a key evicted before
+// refilling to capacity reports OnEvict, not OnDrained.
+func TestTokenBucketCallbacks(t *testing.T) {
+	tb := NewTokenBucketSharded(1000000000, 1000000000, 10000, 1)
+
+	var mu sync.Mutex
+	var evicted, drained []uint64
+	tb.OnEvict = func(key uint64, tokens int64) {
+		mu.Lock()
+		evicted = append(evicted, key)
+		mu.Unlock()
+	}
+	tb.OnDrained = func(key uint64) {
+		mu.Lock()
+		drained = append(drained, key)
+		mu.Unlock()
+	}
+
+	s := tb.shards[0]
+	now := time.Now().UnixNano()
+
+	// Every bucket is taken down to zero and never refills (now never
+	// advances), so gc's forced fallback must report these as OnEvict.
+	for n := 0; n < 10001; n++ {
+		_, _ = s.take(uint64(n), 1000000000, now)
+	}
+
+	mu.Lock()
+	assert.NotEmpty(t, evicted)
+	assert.Empty(t, drained)
+	mu.Unlock()
+}
+
+func TestTokenBucketApproxLRU(t *testing.T) {
+	tb := NewTokenBucketSharded(1000, 100, 10000, 1)
+	tb.EvictionPolicy = EvictApproxLRU
+	s := tb.shards[0]
+
+	now := time.Now().UnixNano()
+
+	for n := 0; n < 10001; n++ {
+		_, _ = s.take(uint64(n), 1000, now)
+	}
+
+	assert.Equal(t, 10000-gcMustRemoveEntries, s.store.Len())
+}